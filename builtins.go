@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	goplugin "plugin"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown"
+	"github.com/open-policy-agent/opa/types"
+	"github.com/open-policy-agent/opa/util"
+)
+
+// builtinManifest is the shape of a --builtins=FILE manifest (JSON or YAML,
+// sniffed the same way test files are in loader.go).
+type builtinManifest struct {
+	Builtins []builtinSpec `json:"builtins" yaml:"builtins"`
+}
+
+// builtinSpec describes one custom builtin to register alongside test.sleep.
+// Exactly one of Rego or Plugin must be set to supply the implementation.
+type builtinSpec struct {
+	Name   string   `json:"name" yaml:"name"`
+	Args   []string `json:"args" yaml:"args"`
+	Result string   `json:"result" yaml:"result"`
+
+	// Rego is a restricted expression, e.g. `sprintf("%v-%v", input.args)`.
+	Rego string `json:"rego,omitempty" yaml:"rego,omitempty"`
+
+	// Plugin is a path to a Go plugin exporting a `Builtin` symbol.
+	Plugin string `json:"plugin,omitempty" yaml:"plugin,omitempty"`
+}
+
+// loadBuiltins reads manifestPath and registers every builtin it describes
+// with both ast.RegisterBuiltin and topdown.RegisterBuiltinFunc.
+func loadBuiltins(manifestPath string) error {
+	bs, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return fmt.Errorf("read builtins manifest: %w", err)
+	}
+
+	var manifest builtinManifest
+	if err := util.Unmarshal(bs, &manifest); err != nil {
+		return fmt.Errorf("parse builtins manifest: %w", err)
+	}
+
+	for _, spec := range manifest.Builtins {
+		if err := registerBuiltin(spec); err != nil {
+			return fmt.Errorf("builtin %q: %w", spec.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func registerBuiltin(spec builtinSpec) error {
+	argTypes := make([]types.Type, len(spec.Args))
+	for i, a := range spec.Args {
+		t, err := builtinType(a)
+		if err != nil {
+			return err
+		}
+		argTypes[i] = t
+	}
+
+	resultType, err := builtinType(spec.Result)
+	if err != nil {
+		return err
+	}
+
+	impl, err := builtinFunc(spec)
+	if err != nil {
+		return err
+	}
+
+	ast.RegisterBuiltin(&ast.Builtin{
+		Name: spec.Name,
+		Decl: types.NewFunction(types.Args(argTypes...), resultType),
+	})
+
+	topdown.RegisterBuiltinFunc(spec.Name, impl)
+	return nil
+}
+
+// builtinType maps the manifest's type names to OPA's ast type system.
+func builtinType(name string) (types.Type, error) {
+	switch name {
+	case "string":
+		return types.S, nil
+	case "number":
+		return types.N, nil
+	case "boolean":
+		return types.B, nil
+	case "null":
+		return types.NewNull(), nil
+	case "any":
+		return types.A, nil
+	default:
+		return nil, fmt.Errorf("unsupported builtin type %q", name)
+	}
+}
+
+func builtinFunc(spec builtinSpec) (topdown.BuiltinFunc, error) {
+	switch {
+	case spec.Plugin != "" && spec.Rego != "":
+		return nil, fmt.Errorf("must set only one of rego or plugin")
+	case spec.Plugin != "":
+		return loadPluginBuiltin(spec.Plugin)
+	case spec.Rego != "":
+		return regoExprBuiltin(spec.Rego), nil
+	default:
+		return nil, fmt.Errorf("must set either rego or plugin")
+	}
+}
+
+// loadPluginBuiltin loads a Go plugin exporting a `Builtin` symbol.
+func loadPluginBuiltin(path string) (topdown.BuiltinFunc, error) {
+	p, err := goplugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open plugin: %w", err)
+	}
+
+	sym, err := p.Lookup("Builtin")
+	if err != nil {
+		return nil, fmt.Errorf("lookup Builtin symbol: %w", err)
+	}
+
+	// Lookup yields a func value for an exported function and a pointer for an
+	// exported variable.
+	switch fn := sym.(type) {
+	case func(topdown.BuiltinContext, []*ast.Term, func(*ast.Term) error) error:
+		return fn, nil
+	case *topdown.BuiltinFunc:
+		return *fn, nil
+	default:
+		return nil, fmt.Errorf("Builtin symbol is %T, want topdown.BuiltinFunc", sym)
+	}
+}
+
+// regoExprBuiltin evaluates expr with input.args bound to the operands and
+// returns the `result` binding.
+func regoExprBuiltin(expr string) topdown.BuiltinFunc {
+	return func(bctx topdown.BuiltinContext, operands []*ast.Term, iter func(*ast.Term) error) error {
+		args := make([]interface{}, len(operands))
+		for i, op := range operands {
+			v, err := ast.JSON(op.Value)
+			if err != nil {
+				return err
+			}
+			args[i] = v
+		}
+
+		r := rego.New(
+			rego.Query(fmt.Sprintf("result := %s", expr)),
+			rego.Input(map[string]interface{}{"args": args}),
+		)
+
+		rs, err := r.Eval(bctx.Context)
+		if err != nil {
+			return err
+		}
+
+		if len(rs) != 1 {
+			return fmt.Errorf("expected exactly one result evaluating builtin expression")
+		}
+
+		result, ok := rs[0].Bindings["result"]
+		if !ok {
+			return fmt.Errorf("builtin expression did not bind result")
+		}
+
+		v, err := ast.InterfaceToValue(result)
+		if err != nil {
+			return err
+		}
+
+		return iter(ast.NewTerm(v))
+	}
+}
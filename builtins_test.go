@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/topdown"
+)
+
+func TestBuiltinType(t *testing.T) {
+	cases := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: "string"},
+		{name: "number"},
+		{name: "boolean"},
+		{name: "null"},
+		{name: "any"},
+		{name: "bogus", wantErr: true},
+	}
+
+	for _, c := range cases {
+		_, err := builtinType(c.name)
+		if c.wantErr && err == nil {
+			t.Errorf("builtinType(%q): expected error, got none", c.name)
+		}
+		if !c.wantErr && err != nil {
+			t.Errorf("builtinType(%q): unexpected error: %v", c.name, err)
+		}
+	}
+}
+
+func TestRegoExprBuiltin(t *testing.T) {
+	fn := regoExprBuiltin(`sprintf("%v-%v", input.args)`)
+
+	a, err := ast.InterfaceToValue("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ast.InterfaceToValue("y")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got *ast.Term
+	bctx := topdown.BuiltinContext{Context: context.Background()}
+	err = fn(bctx, []*ast.Term{ast.NewTerm(a), ast.NewTerm(b)}, func(t *ast.Term) error {
+		got = t
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `"x-y"`
+	if got.String() != want {
+		t.Errorf("got %s, want %s", got.String(), want)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/open-policy-agent/opa/bundle"
+)
+
+// caseManifestEntry records one test case's bundle in the top-level
+// manifest.json.
+type caseManifestEntry struct {
+	File   string `json:"file"`
+	Bundle string `json:"bundle"`
+	Note   string `json:"note"`
+	SHA256 string `json:"sha256"`
+}
+
+// bundleManifest accumulates caseManifestEntry values across generate()'s
+// worker pool and writes them to dstPath/manifest.json.
+type bundleManifest struct {
+	mu      sync.Mutex
+	Entries []caseManifestEntry `json:"cases"`
+}
+
+func (m *bundleManifest) add(e caseManifestEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Entries = append(m.Entries, e)
+}
+
+func (m *bundleManifest) writeTo(dstPath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sort.Slice(m.Entries, func(i, j int) bool { return m.Entries[i].Bundle < m.Entries[j].Bundle })
+
+	bs, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dstPath, "manifest.json"), bs, 0644)
+}
+
+// writeCaseBundle writes a self-contained OPA bundle (bundle.tar.gz) for tc
+// into folderPath, containing the same modules and data a production OPA
+// would load the case with. It returns the bundle's SHA-256 digest for the
+// top-level manifest.
+func writeCaseBundle(folderPath, bundleFileName string, tc *ExtendedTestCase, signingKey string) (string, error) {
+	modules := map[string]string{}
+	for i, mod := range tc.Modules {
+		modules[fmt.Sprintf("mod_%d", i)] = mod
+	}
+	modFiles := getModuleFiles(modules, true)
+
+	b := bundle.Bundle{
+		Manifest: bundle.Manifest{
+			Revision: tc.Note,
+		},
+		Modules: modFiles,
+	}
+
+	if tc.Data != nil {
+		b.Data = *tc.Data
+	}
+
+	if signingKey != "" {
+		if err := signBundle(&b, signingKey); err != nil {
+			return "", fmt.Errorf("sign bundle: %w", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := bundle.NewWriter(&buf).Write(b); err != nil {
+		return "", fmt.Errorf("write bundle: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(folderPath, bundleFileName), buf.Bytes(), 0644); err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// signBundle signs b's module and data files, loading the private key from
+// signingKeyPath.
+func signBundle(b *bundle.Bundle, signingKeyPath string) error {
+	key, err := os.ReadFile(signingKeyPath)
+	if err != nil {
+		return fmt.Errorf("read signing key: %w", err)
+	}
+
+	var files []bundle.FileInfo
+	for _, mf := range b.Modules {
+		files = append(files, bundle.NewFile(mf.Path, mf.Raw, bundle.SHA256))
+	}
+	if dataBytes, err := json.Marshal(b.Data); err == nil {
+		files = append(files, bundle.NewFile("data.json", dataBytes, bundle.SHA256))
+	}
+
+	sc := bundle.NewSigningConfig(string(key), "RS256", "")
+
+	token, err := bundle.GenerateSignedToken(files, sc, "")
+	if err != nil {
+		return fmt.Errorf("generate signed token: %w", err)
+	}
+
+	b.Signatures = bundle.SignaturesConfig{
+		Signatures: []string{token},
+	}
+
+	return nil
+}
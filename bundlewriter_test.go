@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBundleManifestWriteTo(t *testing.T) {
+	m := &bundleManifest{}
+	m.add(caseManifestEntry{Bundle: "b/2.bundle.tar.gz", Note: "two"})
+	m.add(caseManifestEntry{Bundle: "b/1.bundle.tar.gz", Note: "one"})
+
+	dir := t.TempDir()
+	if err := m.writeTo(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got bundleManifest
+	if err := json.Unmarshal(bs, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got.Entries) != 2 || got.Entries[0].Note != "one" || got.Entries[1].Note != "two" {
+		t.Errorf("manifest entries not sorted by bundle path: %+v", got.Entries)
+	}
+}
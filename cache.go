@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/open-policy-agent/opa/logging"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/storage/disk"
+	"github.com/open-policy-agent/opa/version"
+)
+
+// cacheEntry is what gets persisted per (test case, target) cache key.
+type cacheEntry struct {
+	Plan           interface{} `json:"plan,omitempty"`
+	WantPlanResult interface{} `json:"want_plan_result,omitempty"`
+	Wasm           string      `json:"wasm,omitempty"`
+	WantWasmResult interface{} `json:"want_wasm_result,omitempty"`
+}
+
+// Cache is a disk-backed cache of compiled test case results, keyed by a hash
+// of the inputs that affect compilation/evaluation.
+type Cache struct {
+	store storage.Store
+
+	mu           sync.Mutex
+	hits, misses int
+	bytesWritten int64
+}
+
+// openCache opens (or creates) a badger-backed disk store at dir.
+func openCache(ctx context.Context, dir string) (*Cache, error) {
+	store, err := disk.New(ctx, logging.NewNoOpLogger(), disk.Options{
+		Dir: dir,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("open cache dir %s: %w", dir, err)
+	}
+
+	return &Cache{store: store}, nil
+}
+
+func (c *Cache) Close(ctx context.Context) error {
+	if closer, ok := c.store.(interface{ Close(context.Context) error }); ok {
+		return closer.Close(ctx)
+	}
+	return nil
+}
+
+func (c *Cache) Summary() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return fmt.Sprintf("cache hits: %d; misses: %d; bytes written: %d", c.hits, c.misses, c.bytesWritten)
+}
+
+func (c *Cache) recordHit() {
+	c.mu.Lock()
+	c.hits++
+	c.mu.Unlock()
+}
+
+func (c *Cache) recordMiss() {
+	c.mu.Lock()
+	c.misses++
+	c.mu.Unlock()
+}
+
+func (c *Cache) recordBytesWritten(n int64) {
+	c.mu.Lock()
+	c.bytesWritten += n
+	c.mu.Unlock()
+}
+
+// cacheKey hashes the test case inputs and OPA version that affect target's
+// compiled/evaluated result.
+func cacheKey(tc *ExtendedTestCase, entryPoints []string, target string) string {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	_ = enc.Encode(tc.Modules)
+	_ = enc.Encode(tc.Data)
+	_ = enc.Encode(tc.Input)
+	_ = enc.Encode(tc.InputTerm)
+	_ = enc.Encode(entryPoints)
+	_ = enc.Encode(target)
+	_ = enc.Encode(version.Version)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get looks up key, recording a hit or miss.
+func (c *Cache) get(ctx context.Context, key string) (*cacheEntry, bool) {
+	txn, err := c.store.NewTransaction(ctx)
+	if err != nil {
+		c.recordMiss()
+		return nil, false
+	}
+	defer c.store.Abort(ctx, txn)
+
+	path, err := storage.ParsePath("/" + key)
+	if err != nil {
+		c.recordMiss()
+		return nil, false
+	}
+
+	v, err := c.store.Read(ctx, txn, path)
+	if err != nil {
+		c.recordMiss()
+		return nil, false
+	}
+
+	bs, err := json.Marshal(v)
+	if err != nil {
+		c.recordMiss()
+		return nil, false
+	}
+
+	var entry cacheEntry
+	if err := json.Unmarshal(bs, &entry); err != nil {
+		c.recordMiss()
+		return nil, false
+	}
+
+	c.recordHit()
+	return &entry, true
+}
+
+// put persists entry under key, overwriting any previous value.
+func (c *Cache) put(ctx context.Context, key string, entry *cacheEntry) {
+	bs, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(bs, &v); err != nil {
+		return
+	}
+
+	txn, err := c.store.NewTransaction(ctx, storage.WriteParams)
+	if err != nil {
+		return
+	}
+
+	path, err := storage.ParsePath("/" + key)
+	if err != nil {
+		c.store.Abort(ctx, txn)
+		return
+	}
+
+	if err := c.store.Write(ctx, txn, storage.AddOp, path, v); err != nil {
+		c.store.Abort(ctx, txn)
+		return
+	}
+
+	if err := c.store.Commit(ctx, txn); err != nil {
+		return
+	}
+
+	c.recordBytesWritten(int64(len(bs)))
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/open-policy-agent/opa/test/cases"
+)
+
+func TestCacheKey(t *testing.T) {
+	tc := &ExtendedTestCase{
+		TestCase: cases.TestCase{
+			Modules: []string{"package test\n\nallow { true }"},
+		},
+	}
+
+	k1 := cacheKey(tc, []string{"test/allow"}, "plan")
+	k2 := cacheKey(tc, []string{"test/allow"}, "plan")
+	if k1 != k2 {
+		t.Errorf("cacheKey is not deterministic: %q != %q", k1, k2)
+	}
+
+	if k3 := cacheKey(tc, []string{"test/allow"}, "wasm"); k3 == k1 {
+		t.Error("cacheKey does not vary with target")
+	}
+
+	other := &ExtendedTestCase{
+		TestCase: cases.TestCase{
+			Modules: []string{"package test\n\nallow { false }"},
+		},
+	}
+	if k4 := cacheKey(other, []string{"test/allow"}, "plan"); k4 == k1 {
+		t.Error("cacheKey does not vary with modules")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/open-policy-agent/opa/util"
+)
+
+// TestSource streams Test values as they're discovered on disk. Callers must
+// drain Tests() to completion before consulting Err().
+type TestSource interface {
+	Tests() <-chan Test
+	Err() error
+}
+
+// walkTestSource streams one Test per YAML file found under a directory.
+type walkTestSource struct {
+	dirpath string
+	out     chan Test
+	err     error
+}
+
+// newTestSource returns a TestSource that walks dirpath.
+func newTestSource(dirpath string) TestSource {
+	return &walkTestSource{dirpath: dirpath, out: make(chan Test)}
+}
+
+func (s *walkTestSource) Tests() <-chan Test {
+	go func() {
+		defer close(s.out)
+
+		s.err = filepath.Walk(s.dirpath, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if info.IsDir() {
+				return nil
+			}
+
+			bs, err := ioutil.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+
+			var x Test
+			if err := util.Unmarshal(bs, &x); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+
+			for i := range x.Cases {
+				x.Cases[i].Filename = path
+				x.filename = path
+			}
+
+			s.out <- x
+			return nil
+		})
+	}()
+
+	return s.out
+}
+
+func (s *walkTestSource) Err() error {
+	return s.err
+}
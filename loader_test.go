@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWalkTestSource(t *testing.T) {
+	dir := t.TempDir()
+
+	yaml := []byte("cases:\n- note: t/one\n  modules:\n  - |\n    package test\n\n    allow { true }\n")
+	if err := os.WriteFile(filepath.Join(dir, "t.yaml"), yaml, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := newTestSource(dir)
+
+	var got []Test
+	for x := range src.Tests() {
+		got = append(got, x)
+	}
+
+	if err := src.Err(); err != nil {
+		t.Fatalf("Err(): %v", err)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("got %d tests, want 1", len(got))
+	}
+	if len(got[0].Cases) != 1 || got[0].Cases[0].Note != "t/one" {
+		t.Errorf("unexpected cases: %+v", got[0].Cases)
+	}
+}
@@ -2,27 +2,37 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/open-policy-agent/opa/types"
-	"github.com/open-policy-agent/opa/util"
 
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/bundle"
 	"github.com/open-policy-agent/opa/compile"
+	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/storage"
 	"github.com/open-policy-agent/opa/storage/inmem"
 	"github.com/open-policy-agent/opa/test/cases"
 	"github.com/open-policy-agent/opa/topdown"
 )
 
+// supportedTargets are the compile.New().WithTarget() values this tool knows
+// how to produce a test case for.
+var supportedTargets = map[string]bool{
+	"plan": true,
+	"wasm": true,
+}
+
 type ResultMap map[string]interface{}
 
 type ExtendedTestCase struct {
@@ -30,6 +40,8 @@ type ExtendedTestCase struct {
 	EntryPoints    []string    `json:"entrypoints"`
 	Plan           interface{} `json:"plan"`
 	WantPlanResult interface{} `json:"want_plan_result"`
+	Wasm           string      `json:"wasm,omitempty"`
+	WantWasmResult interface{} `json:"want_wasm_result,omitempty"`
 }
 
 type Test struct {
@@ -38,181 +50,264 @@ type Test struct {
 }
 
 func main() {
-	args := os.Args
+	args := os.Args[1:]
+
+	if len(args) > 0 && args[0] == "verify" {
+		os.Exit(runVerify(args[1:]))
+	}
+
+	os.Exit(runGenerate(args))
+}
+
+func runGenerate(args []string) int {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	targetFlag := fs.String("target", "plan", "comma-separated list of compile targets to emit (plan,wasm)")
+	cacheDirFlag := fs.String("cache-dir", "", "directory for the on-disk compile/eval cache (disabled if empty)")
+	noCacheFlag := fs.Bool("no-cache", false, "ignore --cache-dir and always recompile")
+	concurrencyFlag := fs.Int("concurrency", runtime.NumCPU(), "number of test files to compile concurrently")
+	builtinsFlag := fs.String("builtins", "", "path to a JSON/YAML manifest of custom builtins to register (in addition to test.sleep)")
+	bundlesFlag := fs.Bool("bundles", false, "also write a self-contained OPA bundle per case, plus a top-level manifest.json")
+	signingKeyFlag := fs.String("signing-key", "", "path to a PEM private key to sign each case bundle with (requires --bundles)")
+	_ = fs.Parse(args)
+
+	if *builtinsFlag != "" {
+		if err := loadBuiltins(*builtinsFlag); err != nil {
+			panic(err)
+		}
+	}
+
+	targets, err := parseTargets(*targetFlag)
+	if err != nil {
+		panic(err)
+	}
+
 	var srcPath, dstPath string
 
-	switch len(args) {
-	case 2:
+	switch fsArgs := fs.Args(); len(fsArgs) {
+	case 1:
 		srcPath = "opa/test/cases/testdata"
-		dstPath = args[1]
-	case 3:
-		srcPath = args[1]
-		dstPath = args[2]
+		dstPath = fsArgs[0]
+	case 2:
+		srcPath = fsArgs[0]
+		dstPath = fsArgs[1]
 	default:
-		panic(fmt.Sprintf("Usage: %s [SRC] DST", args[0]))
+		panic(fmt.Sprintf("Usage: %s [--target=plan,wasm] [--cache-dir=DIR] [SRC] DST", os.Args[0]))
 	}
 
-	generate(srcPath, dstPath)
-}
+	ctx := context.Background()
 
-func generate(srcPath string, dstPath string) {
-	fmt.Println("Generating compliance tests")
+	var cache *Cache
+	if *cacheDirFlag != "" && !*noCacheFlag {
+		cache, err = openCache(ctx, *cacheDirFlag)
+		if err != nil {
+			panic(err)
+		}
+	}
 
-	successCount, failureCount := 0, 0
+	concurrency := *concurrencyFlag
+	if concurrency < 1 {
+		concurrency = 1
+	}
 
-	for _, t := range loadTests(srcPath) {
-		for _, tc := range t.Cases {
-			// if tc.Note != "withkeyword/with not stack (data)" {
-			// 	continue
-			// }
+	code := generate(srcPath, dstPath, generateOptions{
+		Targets:     targets,
+		Cache:       cache,
+		Concurrency: concurrency,
+		Bundles:     *bundlesFlag,
+		SigningKey:  *signingKeyFlag,
+	})
 
-			modules := map[string]string{}
-			for i, mod := range tc.Modules {
-				modules[fmt.Sprintf("mod_%d", i)] = mod
-			}
-			modFiles := getModuleFiles(modules, false)
+	if cache != nil {
+		cache.Close(ctx)
+	}
 
-			if len(modFiles) == 0 {
-				fmt.Printf("Skipping %s: No modules\n", tc.Note)
-				continue
-			}
+	return code
+}
 
-			var packageNames []string
-			var entryPoints []string
-			for _, modFile := range modFiles {
-				var pkg = modFile.Parsed.Package.Path.String()
-				if len(modFile.Parsed.Rules) == 0 {
-					fmt.Printf("Skipping %s in %s: No rules\n", pkg, tc.Note)
-					continue
-				}
-				packageNames = append(packageNames, pkg)
-				entryPoints = append(entryPoints, strings.ReplaceAll(strings.TrimPrefix(pkg, "data."), ".", "/"))
-			}
-			tc.EntryPoints = entryPoints
+func parseTargets(raw string) ([]string, error) {
+	var targets []string
+	for _, t := range strings.Split(raw, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if !supportedTargets[t] {
+			return nil, fmt.Errorf("unsupported target %q", t)
+		}
+		targets = append(targets, t)
+	}
 
-			b := bundle.Bundle{Modules: modFiles}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets given")
+	}
 
-			compiler := compile.New().
-				WithTarget("plan").
-				WithPruneUnused(true).
-				WithEntrypoints(entryPoints...).
-				WithBundle(&b)
-			if err := compiler.Build(context.Background()); err != nil {
-				fmt.Printf("compile/Skipping %s: %v\n", tc.Note, err)
-				failureCount++
-				continue
-			}
+	return targets, nil
+}
 
-			if len(b.PlanModules) != 1 {
-				fmt.Printf("Unexpected plan count %d for %s\n", len(b.PlanModules), tc.Note)
-				failureCount++
-				continue
-			}
+// generateOptions bundles the knobs that affect how generate() compiles and
+// writes out a corpus.
+type generateOptions struct {
+	Targets     []string
+	Cache       *Cache
+	Concurrency int
+	Bundles     bool
+	SigningKey  string
+}
 
-			if tc.WantError == nil && tc.WantErrorCode == nil {
-				expectedResultSet, err := eval(packageNames, tc)
-				if err != nil {
-					fmt.Printf("eval/Skipping %s: %v\n", tc.Note, err)
-					failureCount++
-					continue
-				}
-
-				if len(expectedResultSet) != 1 {
-					fmt.Printf("Unexpected result count %d for %s\n", len(expectedResultSet), tc.Note)
-					failureCount++
-					continue
-				}
-
-				tc.WantPlanResult = expectedResultSet[0]
-			}
+// generate compiles the corpus under srcPath into dstPath and returns the
+// process exit code: non-zero if any case (including its bundle, when
+// opts.Bundles is set) failed, so a broken/incomplete manifest.json fails CI
+// instead of silently exiting 0.
+func generate(srcPath string, dstPath string, opts generateOptions) int {
+	fmt.Println("Generating compliance tests")
 
-			var plan interface{}
-			if err := json.Unmarshal(b.PlanModules[0].Raw, &plan); err != nil {
-				fmt.Printf("Failed to unmarshal plan: %s\n", err.Error())
-				failureCount++
-				continue
-			} else if plan == nil {
-				fmt.Printf("Failed to unmarshal plan: nil\n")
-				failureCount++
-				continue
-			}
-			tc.Plan = plan
+	source := newTestSource(srcPath)
+	tests := source.Tests()
 
-			successCount++
-		}
+	var manifest *bundleManifest
+	if opts.Bundles {
+		manifest = &bundleManifest{}
+	}
 
-		if tcJson, err := json.MarshalIndent(t, "", "\t"); err != nil {
-			fmt.Printf("Failed to marchal tc to json: %s\n", err.Error())
-			failureCount++
-			continue
-		} else {
-			tPath := strings.Split(t.filename, "/")
-			folderPath := fmt.Sprintf("%s/%s", dstPath, tPath[len(tPath)-2])
-			tcFileName := strings.ReplaceAll(tPath[len(tPath)-1], ".yaml", ".json")
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	successCount, failureCount := 0, 0
 
-			if err := os.MkdirAll(folderPath, 0755); err != nil {
-				panic(err)
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range tests {
+				s, f := processTest(t, dstPath, opts, manifest)
+				mu.Lock()
+				successCount += s
+				failureCount += f
+				mu.Unlock()
 			}
+		}()
+	}
 
-			if err := writeWile(folderPath, tcFileName, tcJson); err != nil {
-				fmt.Printf("Failed to write tc: %s\n", err.Error())
-				failureCount++
-				continue
-			}
+	wg.Wait()
+
+	if err := source.Err(); err != nil {
+		panic(err)
+	}
+
+	if manifest != nil {
+		if err := manifest.writeTo(dstPath); err != nil {
+			panic(err)
 		}
 	}
 
-	fmt.Printf("Tests generated: %d; successes: %d; failures: %d\n", successCount+failureCount, successCount, failureCount)
-}
+	summary := fmt.Sprintf("Tests generated: %d; successes: %d; failures: %d", successCount+failureCount, successCount, failureCount)
+	if opts.Cache != nil {
+		summary += "; " + opts.Cache.Summary()
+	}
+	fmt.Println(summary)
 
-func loadTests(dirpath string) []Test {
+	if failureCount > 0 {
+		return 1
+	}
 
-	var result []Test
+	return 0
+}
 
-	err := filepath.Walk(dirpath, func(path string, info os.FileInfo, err error) error {
+// processTest compiles/evaluates every case in t and writes the resulting
+// JSON file under dstPath, optionally alongside a per-case OPA bundle. It
+// returns the number of successful and failed cases seen.
+func processTest(t Test, dstPath string, opts generateOptions, manifest *bundleManifest) (successCount, failureCount int) {
+	tPath := strings.Split(t.filename, "/")
+	folderPath := fmt.Sprintf("%s/%s", dstPath, tPath[len(tPath)-2])
+	tcFileName := strings.ReplaceAll(tPath[len(tPath)-1], ".yaml", ".json")
 
-		if err != nil {
-			return err
-		}
+	if err := os.MkdirAll(folderPath, 0755); err != nil {
+		panic(err)
+	}
 
-		if info.IsDir() {
-			return nil
+	for i, tc := range t.Cases {
+		modules := map[string]string{}
+		for i, mod := range tc.Modules {
+			modules[fmt.Sprintf("mod_%d", i)] = mod
 		}
 
-		if strings.HasSuffix(path, "test-functions-1006.yaml") {
-			fmt.Printf("break\n")
+		packageNames, entryPoints, ok := moduleEntrypoints(modules, tc.Note)
+		if !ok {
+			continue
 		}
+		tc.EntryPoints = entryPoints
 
-		bs, err := ioutil.ReadFile(path)
-		if err != nil {
-			return fmt.Errorf("%s: %w", path, err)
+		ok = true
+		for _, target := range opts.Targets {
+			if !resolveTarget(opts.Cache, target, modules, entryPoints, packageNames, tc) {
+				ok = false
+			}
 		}
 
-		var x Test
-		if err := util.Unmarshal(bs, &x); err != nil {
-			return fmt.Errorf("%s: %w", path, err)
+		if !ok {
+			failureCount++
+			continue
 		}
 
-		for i := range x.Cases {
-			x.Cases[i].Filename = path
-			x.filename = path
+		if manifest != nil {
+			bundleFileName := fmt.Sprintf("%s-%d.bundle.tar.gz", strings.TrimSuffix(tcFileName, ".json"), i)
+			digest, err := writeCaseBundle(folderPath, bundleFileName, tc, opts.SigningKey)
+			if err != nil {
+				fmt.Printf("Failed to write bundle for %s: %s\n", tc.Note, err.Error())
+				failureCount++
+				continue
+			}
+
+			manifest.add(caseManifestEntry{
+				File:   filepath.Join(tPath[len(tPath)-2], tcFileName),
+				Bundle: filepath.Join(tPath[len(tPath)-2], bundleFileName),
+				Note:   tc.Note,
+				SHA256: digest,
+			})
 		}
 
-		result = append(result, x)
-		return nil
-	})
+		successCount++
+	}
 
-	if err != nil {
-		panic(err)
+	if tcJson, err := json.MarshalIndent(t, "", "\t"); err != nil {
+		fmt.Printf("Failed to marchal tc to json: %s\n", err.Error())
+		failureCount++
+	} else if err := writeWile(folderPath, tcFileName, tcJson); err != nil {
+		fmt.Printf("Failed to write tc: %s\n", err.Error())
+		failureCount++
 	}
 
-	return result
+	return successCount, failureCount
 }
 
 func writeWile(folderPath string, name string, data []byte) error {
 	return os.WriteFile(fmt.Sprintf("%s/%s", folderPath, name), data, 0644)
 }
 
+// moduleEntrypoints parses modules once to derive the package/entrypoint
+// names for a case. The modules parsed here are not reused for
+// compilation: compile.Build() rewrites a module's AST in place, so every
+// compileTarget call re-parses modules fresh instead of compiling an
+// already-lowered AST a second time for another target.
+func moduleEntrypoints(modules map[string]string, note string) (packageNames []string, entryPoints []string, ok bool) {
+	modFiles := getModuleFiles(modules, false)
+	if len(modFiles) == 0 {
+		fmt.Printf("Skipping %s: No modules\n", note)
+		return nil, nil, false
+	}
+
+	for _, modFile := range modFiles {
+		pkg := modFile.Parsed.Package.Path.String()
+		if len(modFile.Parsed.Rules) == 0 {
+			fmt.Printf("Skipping %s in %s: No rules\n", pkg, note)
+			continue
+		}
+		packageNames = append(packageNames, pkg)
+		entryPoints = append(entryPoints, strings.ReplaceAll(strings.TrimPrefix(pkg, "data."), ".", "/"))
+	}
+
+	return packageNames, entryPoints, true
+}
+
 func getModuleFiles(src map[string]string, includeRaw bool) []bundle.ModuleFile {
 
 	var keys []string
@@ -242,6 +337,134 @@ func getModuleFiles(src map[string]string, includeRaw bool) []bundle.ModuleFile
 	return modules
 }
 
+// resolveTarget satisfies target for tc from cache when possible, falling
+// back to compileTarget on a miss (or when caching is disabled) and writing
+// the fresh result back to cache for next time.
+func resolveTarget(cache *Cache, target string, modules map[string]string, entryPoints []string, packageNames []string, tc *ExtendedTestCase) bool {
+	if cache == nil {
+		return compileTarget(target, modules, entryPoints, packageNames, tc)
+	}
+
+	ctx := context.Background()
+	key := cacheKey(tc, entryPoints, target)
+
+	if entry, ok := cache.get(ctx, key); ok {
+		applyCacheEntry(target, entry, tc)
+		return true
+	}
+
+	if !compileTarget(target, modules, entryPoints, packageNames, tc) {
+		return false
+	}
+
+	cache.put(ctx, key, cacheEntryFor(target, tc))
+	return true
+}
+
+// applyCacheEntry restores only the fields target owns onto tc, leaving any
+// fields another target already populated in this run untouched.
+func applyCacheEntry(target string, entry *cacheEntry, tc *ExtendedTestCase) {
+	switch target {
+	case "plan":
+		tc.Plan = entry.Plan
+		tc.WantPlanResult = entry.WantPlanResult
+	case "wasm":
+		tc.Wasm = entry.Wasm
+		tc.WantWasmResult = entry.WantWasmResult
+	}
+}
+
+// cacheEntryFor captures only the fields target owns, since a cache key is
+// scoped to a single target.
+func cacheEntryFor(target string, tc *ExtendedTestCase) *cacheEntry {
+	switch target {
+	case "plan":
+		return &cacheEntry{Plan: tc.Plan, WantPlanResult: tc.WantPlanResult}
+	case "wasm":
+		return &cacheEntry{Wasm: tc.Wasm, WantWasmResult: tc.WantWasmResult}
+	default:
+		return &cacheEntry{}
+	}
+}
+
+// compileTarget compiles tc's modules for the given target and populates the
+// corresponding Plan/Wasm and want-result fields. It returns false (after
+// printing the reason) if the case should be counted as a failure.
+//
+// modules is parsed fresh here (rather than reusing a *ast.Module parsed for
+// another target) because compile.New().Build() rewrites a module's AST in
+// place; compiling the same already-lowered modules a second time for a
+// different target would compile mutated AST, not a fresh parse.
+func compileTarget(target string, modules map[string]string, entryPoints []string, packageNames []string, tc *ExtendedTestCase) bool {
+	modFiles := getModuleFiles(modules, false)
+	b := bundle.Bundle{Modules: modFiles}
+
+	compiler := compile.New().
+		WithTarget(target).
+		WithPruneUnused(true).
+		WithEntrypoints(entryPoints...).
+		WithBundle(&b)
+	if err := compiler.Build(context.Background()); err != nil {
+		fmt.Printf("compile(%s)/Skipping %s: %v\n", target, tc.Note, err)
+		return false
+	}
+
+	switch target {
+	case "plan":
+		if len(b.PlanModules) != 1 {
+			fmt.Printf("Unexpected plan count %d for %s\n", len(b.PlanModules), tc.Note)
+			return false
+		}
+
+		if tc.WantError == nil && tc.WantErrorCode == nil {
+			expectedResultSet, err := eval(packageNames, tc)
+			if err != nil {
+				fmt.Printf("eval/Skipping %s: %v\n", tc.Note, err)
+				return false
+			}
+
+			if len(expectedResultSet) != 1 {
+				fmt.Printf("Unexpected result count %d for %s\n", len(expectedResultSet), tc.Note)
+				return false
+			}
+
+			tc.WantPlanResult = expectedResultSet[0]
+		}
+
+		var plan interface{}
+		if err := json.Unmarshal(b.PlanModules[0].Raw, &plan); err != nil {
+			fmt.Printf("Failed to unmarshal plan: %s\n", err.Error())
+			return false
+		} else if plan == nil {
+			fmt.Printf("Failed to unmarshal plan: nil\n")
+			return false
+		}
+		tc.Plan = plan
+
+	case "wasm":
+		if len(b.WasmModules) != 1 {
+			fmt.Printf("Unexpected wasm module count %d for %s\n", len(b.WasmModules), tc.Note)
+			return false
+		}
+		tc.Wasm = base64.StdEncoding.EncodeToString(b.WasmModules[0].Raw)
+
+		if tc.WantError == nil && tc.WantErrorCode == nil {
+			result, err := evalWasm(packageNames, &b, tc)
+			if err != nil {
+				fmt.Printf("eval(wasm)/Skipping %s: %v\n", tc.Note, err)
+				return false
+			}
+			tc.WantWasmResult = result
+		}
+
+	default:
+		fmt.Printf("Unknown target %q for %s\n", target, tc.Note)
+		return false
+	}
+
+	return true
+}
+
 func createQuery(packageNames []string) ast.Body {
 	q := ast.Body{}
 	for _, pkg := range packageNames {
@@ -252,6 +475,15 @@ func createQuery(packageNames []string) ast.Body {
 	return q
 }
 
+func createQueryString(packageNames []string) string {
+	var exprs []string
+	for _, pkg := range packageNames {
+		exprs = append(exprs, fmt.Sprintf("%s = %s", strings.ReplaceAll(pkg, ".", "_"), pkg))
+	}
+
+	return strings.Join(exprs, "; ")
+}
+
 func eval(packageNames []string, tc *ExtendedTestCase) ([]ResultMap, error) {
 	// log.Printf("\nE: %v", packageNames)
 	ctx := context.Background()
@@ -321,6 +553,50 @@ func eval(packageNames []string, tc *ExtendedTestCase) ([]ResultMap, error) {
 	return resultSet, nil
 }
 
+// evalWasm evaluates the wasm module already compiled into b in-process, the
+// same way a downstream wasm-based OPA implementation would, so the result
+// can be recorded as want_wasm_result alongside the plan's want_plan_result.
+func evalWasm(packageNames []string, b *bundle.Bundle, tc *ExtendedTestCase) (ResultMap, error) {
+	ctx := context.Background()
+
+	if tc.Data != nil {
+		b.Data = *tc.Data
+	}
+
+	var input interface{}
+	if tc.InputTerm != nil {
+		v, err := ast.JSON(ast.MustParseTerm(*tc.InputTerm).Value)
+		if err != nil {
+			return nil, err
+		}
+		input = v
+	} else if tc.Input != nil {
+		input = *tc.Input
+	}
+
+	r := rego.New(
+		rego.Query(createQueryString(packageNames)),
+		rego.ParsedBundle("test", b),
+		rego.Target("wasm"),
+		rego.StrictBuiltinErrors(tc.StrictError),
+		rego.Input(input),
+	)
+
+	rs, err := r.Eval(ctx)
+	if err != nil {
+		if tc.WantErrorCode != nil || tc.WantError != nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if len(rs) != 1 {
+		return nil, fmt.Errorf("ResultSet contains %d entries, expected 1", len(rs))
+	}
+
+	return ResultMap(rs[0].Bindings), nil
+}
+
 func init() {
 	// Used by the 'time/time caching' test
 	ast.RegisterBuiltin(&ast.Builtin{
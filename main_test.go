@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTargets(t *testing.T) {
+	cases := []struct {
+		raw     string
+		want    []string
+		wantErr bool
+	}{
+		{raw: "plan", want: []string{"plan"}},
+		{raw: "plan,wasm", want: []string{"plan", "wasm"}},
+		{raw: " plan , wasm ", want: []string{"plan", "wasm"}},
+		{raw: "", wantErr: true},
+		{raw: "bogus", wantErr: true},
+	}
+
+	for _, c := range cases {
+		got, err := parseTargets(c.raw)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("parseTargets(%q): expected error, got none", c.raw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTargets(%q): unexpected error: %v", c.raw, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseTargets(%q) = %v, want %v", c.raw, got, c.want)
+		}
+	}
+}
+
+// TestCompileTargetPlanAndWasm guards against compiling the same already-
+// rewritten module AST twice: it runs "plan" then "wasm" over one case and
+// checks both want_plan_result and want_wasm_result come out populated, with
+// neither target's fields clobbered by the other.
+func TestCompileTargetPlanAndWasm(t *testing.T) {
+	modules := map[string]string{
+		"test.rego": `package test
+
+allow { input.x == 1 }`,
+	}
+
+	packageNames, entryPoints, ok := moduleEntrypoints(modules, "plan+wasm")
+	if !ok {
+		t.Fatal("moduleEntrypoints: no entrypoints found")
+	}
+
+	tc := &ExtendedTestCase{}
+	tc.Modules = []string{modules["test.rego"]}
+	var input interface{} = map[string]interface{}{"x": float64(1)}
+	tc.Input = &input
+
+	if !compileTarget("plan", modules, entryPoints, packageNames, tc) {
+		t.Fatal("compileTarget(plan) failed")
+	}
+	if tc.Plan == nil {
+		t.Error("plan is nil after the plan target")
+	}
+	if tc.WantPlanResult == nil {
+		t.Error("want_plan_result is nil after the plan target")
+	}
+
+	if !compileTarget("wasm", modules, entryPoints, packageNames, tc) {
+		t.Fatal("compileTarget(wasm) failed")
+	}
+	if tc.Wasm == "" {
+		t.Error("wasm is empty after the wasm target")
+	}
+	if tc.WantWasmResult == nil {
+		t.Error("want_wasm_result is nil after the wasm target")
+	}
+
+	if tc.Plan == nil || tc.WantPlanResult == nil {
+		t.Error("plan target's fields were clobbered by the wasm target")
+	}
+}
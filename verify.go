@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// caseDrift describes how a single case's recompiled/re-evaluated output
+// differs from what's currently on disk under dstPath.
+type caseDrift struct {
+	File                  string `json:"file"`
+	Note                  string `json:"note"`
+	PlanChanged           bool   `json:"plan_changed,omitempty"`
+	WantPlanResultChanged bool   `json:"want_plan_result_changed,omitempty"`
+	WasmChanged           bool   `json:"wasm_changed,omitempty"`
+	WantWasmResultChanged bool   `json:"want_wasm_result_changed,omitempty"`
+	NewlyFailing          bool   `json:"newly_failing,omitempty"`
+	NewlyPassing          bool   `json:"newly_passing,omitempty"`
+	Error                 string `json:"error,omitempty"`
+}
+
+// verifyReport is the machine-readable form of a verify run, suitable for a
+// CI job to post as a structured PR comment.
+type verifyReport struct {
+	CasesChecked int         `json:"cases_checked"`
+	Drifted      int         `json:"drifted"`
+	Diffs        []caseDrift `json:"diffs"`
+}
+
+// runVerify implements the `verify` subcommand: it recompiles/re-evaluates
+// every case already generated under dstPath and reports any drift against
+// what's currently on disk there. It returns the process exit code, non-zero
+// on any drift.
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	targetFlag := fs.String("target", "plan", "comma-separated list of compile targets to verify (plan,wasm)")
+	jsonFlag := fs.Bool("json", false, "emit a machine-readable JSON report instead of text")
+	builtinsFlag := fs.String("builtins", "", "path to a JSON/YAML manifest of custom builtins to register (in addition to test.sleep)")
+	_ = fs.Parse(args)
+
+	if *builtinsFlag != "" {
+		if err := loadBuiltins(*builtinsFlag); err != nil {
+			panic(err)
+		}
+	}
+
+	targets, err := parseTargets(*targetFlag)
+	if err != nil {
+		panic(err)
+	}
+
+	fsArgs := fs.Args()
+	if len(fsArgs) != 1 {
+		panic(fmt.Sprintf("Usage: %s verify [--target=plan,wasm] [--json] DST", os.Args[0]))
+	}
+
+	report, err := verify(fsArgs[0], targets)
+	if err != nil {
+		panic(err)
+	}
+
+	if *jsonFlag {
+		bs, err := json.MarshalIndent(report, "", "\t")
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(bs))
+	} else {
+		fmt.Printf("Cases checked: %d; drifted: %d\n", report.CasesChecked, report.Drifted)
+		for _, d := range report.Diffs {
+			fmt.Printf("DRIFT %s (%s): plan_changed=%v want_plan_result_changed=%v wasm_changed=%v want_wasm_result_changed=%v newly_failing=%v newly_passing=%v",
+				d.File, d.Note, d.PlanChanged, d.WantPlanResultChanged, d.WasmChanged, d.WantWasmResultChanged, d.NewlyFailing, d.NewlyPassing)
+			if d.Error != "" {
+				fmt.Printf(" error=%q", d.Error)
+			}
+			fmt.Println()
+		}
+	}
+
+	if report.Drifted > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// verify walks the previously generated *.json files under dstPath,
+// recompiles/re-evaluates each case for targets, and diffs the fresh result
+// against what's on disk.
+func verify(dstPath string, targets []string) (*verifyReport, error) {
+	report := &verifyReport{}
+
+	err := filepath.Walk(dstPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		var t Test
+		if err := json.Unmarshal(bs, &t); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		for _, tc := range t.Cases {
+			report.CasesChecked++
+			if d := verifyCase(path, tc, targets); d != nil {
+				report.Diffs = append(report.Diffs, *d)
+				report.Drifted++
+			}
+		}
+
+		return nil
+	})
+
+	return report, err
+}
+
+// jsonEqual compares a and b by their JSON representation rather than their
+// Go dynamic type, since a ResultMap and a plain map[string]interface{}
+// decoded from disk are never reflect.DeepEqual even with identical data.
+func jsonEqual(a, b interface{}) bool {
+	an, aerr := normalizeJSON(a)
+	bn, berr := normalizeJSON(b)
+	if aerr != nil || berr != nil {
+		return reflect.DeepEqual(a, b)
+	}
+
+	return reflect.DeepEqual(an, bn)
+}
+
+func normalizeJSON(v interface{}) (interface{}, error) {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var out interface{}
+	if err := json.Unmarshal(bs, &out); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// verifyCase recompiles/re-evaluates a single case in place and returns the
+// drift found, or nil if the case reproduced exactly.
+func verifyCase(path string, tc *ExtendedTestCase, targets []string) *caseDrift {
+	prevPlan := tc.Plan
+	prevWantPlan := tc.WantPlanResult
+	prevWasm := tc.Wasm
+	prevWantWasm := tc.WantWasmResult
+
+	modules := map[string]string{}
+	for i, mod := range tc.Modules {
+		modules[fmt.Sprintf("mod_%d", i)] = mod
+	}
+
+	packageNames, entryPoints, ok := moduleEntrypoints(modules, tc.Note)
+	if !ok {
+		return nil
+	}
+
+	drift := &caseDrift{File: path, Note: tc.Note}
+	drifted := false
+
+	for _, target := range targets {
+		// Clear the target's fields first, so a recompile that fails shows up
+		// as a result going from set to nil instead of keeping the old value.
+		applyCacheEntry(target, &cacheEntry{}, tc)
+		if !compileTarget(target, modules, entryPoints, packageNames, tc) {
+			drift.Error = fmt.Sprintf("recompile failed for target %q", target)
+			drifted = true
+		}
+	}
+
+	if !reflect.DeepEqual(prevPlan, tc.Plan) {
+		drift.PlanChanged = true
+		drifted = true
+	}
+
+	if !jsonEqual(prevWantPlan, tc.WantPlanResult) {
+		drift.WantPlanResultChanged = true
+		drifted = true
+		switch {
+		case prevWantPlan == nil && tc.WantPlanResult != nil:
+			drift.NewlyPassing = true
+		case prevWantPlan != nil && tc.WantPlanResult == nil:
+			drift.NewlyFailing = true
+		}
+	}
+
+	if prevWasm != tc.Wasm {
+		drift.WasmChanged = true
+		drifted = true
+	}
+
+	if !jsonEqual(prevWantWasm, tc.WantWasmResult) {
+		drift.WantWasmResultChanged = true
+		drifted = true
+		switch {
+		case prevWantWasm == nil && tc.WantWasmResult != nil:
+			drift.NewlyPassing = true
+		case prevWantWasm != nil && tc.WantWasmResult == nil:
+			drift.NewlyFailing = true
+		}
+	}
+
+	if !drifted {
+		return nil
+	}
+
+	return drift
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/open-policy-agent/opa/test/cases"
+)
+
+func TestJSONEqual(t *testing.T) {
+	a := ResultMap{"x": float64(1)}
+	var b interface{} = map[string]interface{}{"x": float64(1)}
+
+	if !jsonEqual(a, b) {
+		t.Error("jsonEqual(a, b) = false, want true for equal data with different dynamic types")
+	}
+
+	var c interface{} = map[string]interface{}{"x": float64(2)}
+	if jsonEqual(a, c) {
+		t.Error("jsonEqual(a, c) = true, want false for different data")
+	}
+}
+
+func TestVerifyCaseDetectsNewlyFailing(t *testing.T) {
+	tc := &ExtendedTestCase{
+		TestCase: cases.TestCase{
+			Modules: []string{"package test\n\nallow { undefined_fn(input.x) }"},
+		},
+		WantPlanResult: ResultMap{"x": float64(1)},
+	}
+
+	drift := verifyCase("test.json", tc, []string{"plan"})
+	if drift == nil {
+		t.Fatal("expected drift, got none")
+	}
+	if !drift.WantPlanResultChanged {
+		t.Error("expected want_plan_result_changed")
+	}
+	if !drift.NewlyFailing {
+		t.Error("expected newly_failing when want_plan_result goes from set to nil")
+	}
+}